@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// maxGuaranteedUpdateRetries bounds how many times GuaranteedUpdate retries
+// a read-modify-write before giving up with a ConflictError.
+const maxGuaranteedUpdateRetries = 3
+
+// UpdateItemRequest is the Data payload of an "updateItem" wsRequest. It
+// carries the ResourceVersion the client last observed, so concurrent
+// edits to the same item no longer silently clobber one another.
+type UpdateItemRequest struct {
+	ID              int64
+	ResourceVersion int64
+	Patch           StatusPatch
+}
+
+// StatusPatch is a field-set patch applied to a Status by GuaranteedUpdate.
+// Only non-nil fields are changed.
+type StatusPatch struct {
+	Name     *string
+	Progress *float64
+}
+
+// Apply returns current with the patch's non-nil fields merged in.
+func (p StatusPatch) Apply(current Status) Status {
+	if p.Name != nil {
+		current.Name = *p.Name
+	}
+	if p.Progress != nil {
+		current.Progress = *p.Progress
+		current.Status = fmt.Sprintf("%.2f %%", *p.Progress*100)
+	}
+	return current
+}
+
+// ConflictError is returned by GuaranteedUpdate when it could not commit
+// apply's result: either the caller's expected ResourceVersion was already
+// stale, or the item's ResourceVersion kept moving out from under it.
+// Handlers map this to HTTP 409.
+type ConflictError struct {
+	ID              int64
+	ExpectedVersion int64
+	ActualVersion   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting update for item %d: expected resource version %d, found %d", e.ID, e.ExpectedVersion, e.ActualVersion)
+}
+
+// GuaranteedUpdate applies apply to the current Status for id, writing the
+// result back with ResourceVersion bumped by one. This borrows the
+// guarded-update pattern used by Kubernetes' etcd3 store: it reads the
+// current Status outside the write lock, computes the new Status with
+// apply, then commits only if the ResourceVersion has not moved since the
+// read. If another concurrent updateItem lands in between, it retries
+// against the fresh state up to maxGuaranteedUpdateRetries times before
+// giving up with a *ConflictError. The background randomiseAllItems ticker
+// deliberately does not bump ResourceVersion, so it never triggers a
+// retry or a false conflict here.
+func (s *Store) GuaranteedUpdate(
+	ctx context.Context,
+	id int64,
+	expectedRV int64,
+	apply func(current Status) (Status, error),
+) (Status, error) {
+	var observedRV int64
+
+	for attempt := 0; attempt <= maxGuaranteedUpdateRetries; attempt++ {
+		s.RLock()
+		current, ok := s.m[id]
+		s.RUnlock()
+		if !ok {
+			return Status{}, fmt.Errorf("item to update does not exist: %d", id)
+		}
+		observedRV = current.ResourceVersion
+
+		proposed, err := apply(current)
+		if err != nil {
+			return Status{}, err
+		}
+
+		s.Lock()
+		latest, ok := s.m[id]
+		if !ok {
+			s.Unlock()
+			return Status{}, fmt.Errorf("item to update does not exist: %d", id)
+		}
+		if latest.ResourceVersion != observedRV {
+			// Something else wrote to this item between our read and our
+			// write - retry against the state we just observed. expectedRV
+			// (the caller's baseline) is untouched, so a stale caller still
+			// can't sneak a commit through on a later attempt.
+			s.Unlock()
+			continue
+		}
+		if observedRV != expectedRV {
+			// The state is unchanged since our read, so this is not a
+			// self-race - the caller's baseline was already stale before
+			// this call started. Reject rather than retry.
+			s.Unlock()
+			return Status{}, &ConflictError{ID: id, ExpectedVersion: expectedRV, ActualVersion: observedRV}
+		}
+
+		proposed.ID = id
+		proposed.ResourceVersion = latest.ResourceVersion + 1
+		s.m[id] = proposed
+
+		err = s.backend.Put(ctx, proposed)
+		if err != nil {
+			s.Unlock()
+			return Status{}, err
+		}
+		s.Unlock()
+
+		s.updates.Broadcast()
+		return proposed, nil
+	}
+
+	return Status{}, &ConflictError{ID: id, ExpectedVersion: expectedRV, ActualVersion: observedRV}
+}
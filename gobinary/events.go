@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/calmdocs/keyexchange"
+)
+
+// eventsHeartbeatInterval is how often handleEvents sends a comment-only
+// SSE frame to keep idle connections (and any intermediate proxies) alive.
+const eventsHeartbeatInterval = 15 * time.Second
+
+// Diff returns the items in the Store that do not value-equal (every
+// Status field is compared, so a change to Progress alone counts even
+// though it leaves ResourceVersion as it was) an entry in the provided
+// known status list. An item with no matching ID in known is
+// always returned. This is shared by the /request long poll (the "ping"
+// case in wsHandleInput) and the /events SSE stream.
+func (s *Store) Diff(known []Status) []Status {
+	s.RLock()
+	defer s.RUnlock()
+
+	diff := []Status{}
+	for _, wd := range s.m {
+		isClone := false
+		for _, v := range known {
+			if v == wd {
+				isClone = true
+				break
+			}
+		}
+		if isClone {
+			continue
+		}
+		diff = append(diff, wd)
+	}
+	return diff
+}
+
+// diffEvents compares the Store's current items against known (keyed by
+// ID) and returns the Events needed to bring known up to date: an EventPut
+// for every added or changed item, and an EventDelete for every item known
+// once held but the Store no longer has. Unlike Diff (used by the
+// one-shot /request long poll), this also surfaces deletions, since
+// /events is a standing subscription that must not leak items the Store
+// has since removed.
+func (s *Store) diffEvents(known map[int64]Status) []Event {
+	s.RLock()
+	defer s.RUnlock()
+
+	events := []Event{}
+	for id, wd := range s.m {
+		if prev, ok := known[id]; !ok || prev != wd {
+			events = append(events, Event{Type: EventPut, Status: wd, ID: id})
+		}
+	}
+	for id := range known {
+		if _, ok := s.m[id]; !ok {
+			events = append(events, Event{Type: EventDelete, ID: id})
+		}
+	}
+	return events
+}
+
+// handleEvents upgrades the request to a Server-Sent Events stream. It
+// pushes an Event per added, changed, or deleted item whenever s.updates
+// fires, plus a periodic heartbeat frame so idle connections don't time
+// out. Clients subscribe once, rather than repeatedly reopening /request.
+func (s *Store) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Each SSE stream gets its own subscription, so it is woken on every
+	// update independently of any /request long polls or other /events
+	// streams also waiting on s.updates.
+	updateCh := s.updates.Subscribe()
+	defer s.updates.Unsubscribe(updateCh)
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	known := map[int64]Status{}
+	for {
+		events := s.diffEvents(known)
+		if len(events) > 0 {
+			err := s.writeEventFrame(w, events)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+			flusher.Flush()
+
+			for _, ev := range events {
+				switch ev.Type {
+				case EventPut:
+					known[ev.ID] = ev.Status
+				case EventDelete:
+					delete(known, ev.ID)
+				}
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updateCh:
+		case <-heartbeat.C:
+			_, err := w.Write([]byte(": heartbeat\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEventFrame encrypts v (using a fresh timestamp as the additional
+// data, matching the /request long poll) and writes it as a single SSE
+// "data:" frame.
+func (s *Store) writeEventFrame(w http.ResponseWriter, v []Event) error {
+	b, err := s.keyexchangeStore.EncodeJSONAndEncryptToJSON(
+		v,
+		keyexchange.CurrentTimestampBytes(),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
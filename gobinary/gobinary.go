@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -22,11 +23,12 @@ import (
 )
 
 type Status struct {
-	ID       int64
-	Error    error
-	Name     string
-	Status   string
-	Progress float64
+	ID              int64
+	Error           error
+	Name            string
+	Status          string
+	Progress        float64
+	ResourceVersion int64
 }
 
 type Request struct {
@@ -38,13 +40,14 @@ type Request struct {
 type Store struct {
 	sync.RWMutex
 
-	m        map[int64]Status
-	updateCh chan bool
-	maxID    int64
+	m       map[int64]Status
+	updates *notifier
+	maxID   int64
 
-	authToken               string
-	keyexchangeStore        *keyexchange.Store
-	additionalDataTimestamp int64
+	jwtSecret        []byte
+	keyexchangeStore *keyexchange.Store
+	replay           *replayCache
+	backend          StorageBackend
 }
 
 func main() {
@@ -54,6 +57,11 @@ func main() {
 	// Flag variables
 	killPID := flag.Int("pid", 0, "source process identifier (pid)") // -pid=7423
 	authToken := flag.String("token", "", "authentication token")
+	jwtSecretFlag := flag.String("jwt-secret", "", "JWT HS256 signing secret (defaults to -token if unset)")
+	storageFlag := flag.String("storage", "memory", `storage backend: "memory" (default) or "bolt:///path/to/state.db"`)
+	replayWindow := flag.Duration("replay-window", 30*time.Second, "how far in the past an additional-data timestamp may be and still be accepted")
+	replaySkew := flag.Duration("replay-skew", 5*time.Second, "how far in the future an additional-data timestamp may be (clock skew) and still be accepted")
+	replayCacheSize := flag.Int("replay-cache-size", 1024, "number of recently seen additional-data hashes to retain for replay detection")
 	port := flag.Int("port", 0, "port")
 
 	flag.Parse()
@@ -91,12 +99,38 @@ func main() {
 	}
 	fmt.Println(pemString)
 
-	// Create store and randomise all items (every 1.25 seconds)
+	// JWT bearer tokens are signed with -jwt-secret, falling back to -token
+	// so a single flag still works for the common single-user case
+	jwtSecret := []byte(*jwtSecretFlag)
+	if len(jwtSecret) == 0 {
+		jwtSecret = []byte(*authToken)
+	}
+
+	// Create the storage backend and store
+	backend, err := ParseStorageBackend(*storageFlag)
+	if err != nil {
+		panic(err)
+	}
 	s := NewStore(
-		*authToken,
+		jwtSecret,
 		keyexchangeStore,
-		keyexchange.CurrentTimestamp(),
+		newReplayCache(*replayWindow, *replaySkew, *replayCacheSize),
+		backend,
 	)
+
+	// Rehydrate s.m/s.maxID from the backend so items survive a restart of
+	// the parent process, then start watching the backend for writes made
+	// by other processes sharing it
+	err = s.rehydrate(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = s.watchBackend(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	// Randomise all items every 1.25 seconds
 	go func() {
 		ticker := time.NewTicker(1250 * time.Millisecond)
 		defer ticker.Stop()
@@ -105,35 +139,20 @@ func main() {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				s.randomiseAllItems()
+				err := s.randomiseAllItems(ctx)
+				if err != nil {
+					fmt.Println(err.Error())
+				}
 			}
 		}
 	}()
 
 	// Create mux router
 	r := mux.NewRouter().StrictSlash(true)
+	r.Use(localOnly)
+	r.Use(jwtAuth(s.jwtSecret))
 	r.HandleFunc("/request", func(w http.ResponseWriter, r *http.Request) {
 
-		// Local access only
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if ip != "127.0.0.1" {
-			fmt.Println("remote access forbidden:", ip)
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		// Auth
-		bearerToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-		if bearerToken != *authToken {
-			fmt.Printf("auth failure (bearerToken: %s, authToken: %s)\n", bearerToken, *authToken)
-			http.Error(w, "id error", http.StatusForbidden)
-			return
-		}
-
 		// Get wsRequest
 		var wsRequest Request
 		b, err := io.ReadAll(r.Body)
@@ -149,17 +168,12 @@ func main() {
 			&wsRequest,
 			func(additionalData []byte) (bool, error) {
 
-				// Only process new messages
-				ok, i, err := keyexchange.AuthTimestamp(additionalData, s.additionalDataTimestamp)
+				// Reject replays and out-of-window timestamps
+				err := s.replay.Check(additionalData)
 				if err != nil {
 					fmt.Println(err.Error())
 					return false, err
 				}
-				if !ok {
-					fmt.Println("auth timestamp failure")
-					return false, nil
-				}
-				s.additionalDataTimestamp = i
 				return true, nil
 			},
 		)
@@ -173,13 +187,35 @@ func main() {
 		err = s.wsHandleInput(r.Context(), wsRequest, w)
 		if err != nil {
 			fmt.Println(err.Error())
+			var conflict *ConflictError
+			if errors.As(err, &conflict) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	})
+	r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+
+		// Scope
+		claims, ok := claimsFromContext(r.Context())
+		if !ok || !claims.HasScope(ScopeItemsRead) {
+			http.Error(w, "id error", http.StatusForbidden)
+			return
+		}
 
-	// Create the first item
-	s.newItem()
+		s.handleEvents(w, r)
+	}).Methods("GET")
+
+	// Create the first item, unless existing items were just rehydrated
+	// from the backend
+	if len(s.m) == 0 {
+		err = s.newItem(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	// Create http server
 	httpServer := http.Server{
@@ -199,36 +235,116 @@ func main() {
 	}
 }
 
+// localOnly is mux middleware that rejects requests not originating from
+// this machine.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if ip != "127.0.0.1" {
+			fmt.Println("remote access forbidden:", ip)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func NewStore(
-	authToken string,
+	jwtSecret []byte,
 	keyexchangeStore *keyexchange.Store,
-	additionalDataTimestamp int64,
+	replay *replayCache,
+	backend StorageBackend,
 ) *Store {
 	return &Store{
-		m:                       make(map[int64]Status),
-		updateCh:                make(chan bool, 5),
-		maxID:                   0,
-		authToken:               authToken,
-		keyexchangeStore:        keyexchangeStore,
-		additionalDataTimestamp: additionalDataTimestamp,
+		m:                make(map[int64]Status),
+		updates:          newNotifier(),
+		maxID:            0,
+		jwtSecret:        jwtSecret,
+		keyexchangeStore: keyexchangeStore,
+		replay:           replay,
+		backend:          backend,
+	}
+}
+
+// rehydrate loads persisted items from s.backend into s.m / s.maxID. Call
+// this once at startup, before the first s.newItem(), so existing items
+// survive a restart of the parent process.
+func (s *Store) rehydrate(ctx context.Context) error {
+	m, maxID, err := s.backend.Load(ctx)
+	if err != nil {
+		return err
 	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.m = m
+	s.maxID = maxID
+	return nil
+}
+
+// watchBackend applies backend-originated Events (e.g. writes made by
+// another process sharing the same storage) to s.m and wakes any /request
+// long poll or /events SSE clients via s.updates.
+func (s *Store) watchBackend(ctx context.Context) error {
+	events, err := s.backend.Watch(ctx)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for event := range events {
+			s.Lock()
+			switch event.Type {
+			case EventPut:
+				s.m[event.Status.ID] = event.Status
+				if event.Status.ID > s.maxID {
+					s.maxID = event.Status.ID
+				}
+			case EventDelete:
+				delete(s.m, event.ID)
+			}
+			s.Unlock()
+
+			s.updates.Broadcast()
+		}
+	}()
+	return nil
 }
 
 func (s *Store) wsHandleInput(ctx context.Context, wsRequest Request, w http.ResponseWriter) (err error) {
 
+	// Claims are attached to ctx by the jwtAuth middleware
+	claims, ok := claimsFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("missing auth claims")
+	}
+
 	// Handle message
 	switch wsRequest.Type {
 
 	case "ping":
+		if !claims.HasScope(ScopeItemsRead) {
+			return fmt.Errorf("missing scope: %s", ScopeItemsRead)
+		}
 
 		// Unmarshal inStatus
+		dataString, ok := wsRequest.Data.(string)
+		if !ok {
+			return fmt.Errorf("request data is not a string: %v", wsRequest.Data)
+		}
 		var inStatus []Status
-		err = json.Unmarshal([]byte(wsRequest.Data.(string)), &inStatus)
+		err = json.Unmarshal([]byte(dataString), &inStatus)
 		if err != nil {
 			return err
 		}
 
 		// Long poll until the local status does not match the inStatus
+		updateCh := s.updates.Subscribe()
+		defer s.updates.Unsubscribe(updateCh)
+
 		m := []Status{}
 		done := false
 		for !done {
@@ -240,25 +356,7 @@ func (s *Store) wsHandleInput(ctx context.Context, wsRequest Request, w http.Res
 			default:
 			}
 
-			m = []Status{}
-			for _, wd := range s.m {
-				wd = wd
-
-				isClone := false
-				for _, v := range inStatus {
-					v = v
-					switch {
-					case v.ID != wd.ID:
-					case v.Status != wd.Status:
-					default:
-						isClone = true
-					}
-				}
-				if isClone {
-					continue
-				}
-				m = append(m, wd)
-			}
+			m = s.Diff(inStatus)
 
 			// Wait for status change if there is no updates to inStatus
 			if len(inStatus) != 0 && len(m) == 0 {
@@ -267,7 +365,7 @@ func (s *Store) wsHandleInput(ctx context.Context, wsRequest Request, w http.Res
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				case <-s.updateCh:
+				case <-updateCh:
 				}
 				continue
 			}
@@ -291,9 +389,18 @@ func (s *Store) wsHandleInput(ctx context.Context, wsRequest Request, w http.Res
 		}
 
 	case "addItem":
-		s.newItem()
+		if !claims.HasScope(ScopeItemsAdd) {
+			return fmt.Errorf("missing scope: %s", ScopeItemsAdd)
+		}
+		err = s.newItem(ctx)
+		if err != nil {
+			return err
+		}
 
 	case "deleteItem":
+		if !claims.HasScope(ScopeItemsDelete) {
+			return fmt.Errorf("missing scope: %s", ScopeItemsDelete)
+		}
 		itemString, ok := wsRequest.ID.(string)
 		if !ok {
 			return fmt.Errorf("request identifier is not a string: %v", wsRequest.ID)
@@ -302,11 +409,42 @@ func (s *Store) wsHandleInput(ctx context.Context, wsRequest Request, w http.Res
 		if err != nil {
 			return err
 		}
-		ok = s.deleteItem(itemID)
+		if !claims.AllowsItemID(itemID) {
+			return fmt.Errorf("item id not permitted by token: %d", itemID)
+		}
+		ok, err = s.deleteItem(ctx, itemID)
+		if err != nil {
+			return err
+		}
 		if !ok {
 			return fmt.Errorf("item to delete does not exist: %d", itemID)
 		}
 
+	case "updateItem":
+		if !claims.HasScope(ScopeItemsUpdate) {
+			return fmt.Errorf("missing scope: %s", ScopeItemsUpdate)
+		}
+
+		dataString, ok := wsRequest.Data.(string)
+		if !ok {
+			return fmt.Errorf("request data is not a string: %v", wsRequest.Data)
+		}
+		var updateRequest UpdateItemRequest
+		err = json.Unmarshal([]byte(dataString), &updateRequest)
+		if err != nil {
+			return err
+		}
+		if !claims.AllowsItemID(updateRequest.ID) {
+			return fmt.Errorf("item id not permitted by token: %d", updateRequest.ID)
+		}
+
+		_, err = s.GuaranteedUpdate(ctx, updateRequest.ID, updateRequest.ResourceVersion, func(current Status) (Status, error) {
+			return updateRequest.Patch.Apply(current), nil
+		})
+		if err != nil {
+			return err
+		}
+
 	default:
 		return fmt.Errorf("unrecognised inbound ws message: %#v", wsRequest)
 	}
@@ -314,58 +452,72 @@ func (s *Store) wsHandleInput(ctx context.Context, wsRequest Request, w http.Res
 
 }
 
-func (s *Store) newItem() {
+func (s *Store) newItem(ctx context.Context) error {
 	s.Lock()
 	defer s.Unlock()
 
 	s.maxID += 1
-	s.m[s.maxID] = Status{
-		ID:       s.maxID,
-		Error:    nil,
-		Name:     fmt.Sprintf("entry %d", s.maxID),
-		Status:   fmt.Sprintf("%.2f %%", float64(0)*100),
-		Progress: 0,
+	status := Status{
+		ID:              s.maxID,
+		Error:           nil,
+		Name:            fmt.Sprintf("entry %d", s.maxID),
+		Status:          fmt.Sprintf("%.2f %%", float64(0)*100),
+		Progress:        0,
+		ResourceVersion: 1,
 	}
+	s.m[s.maxID] = status
 
-	select {
-	case s.updateCh <- true:
-	default:
+	err := s.backend.Put(ctx, status)
+	if err != nil {
+		return err
 	}
+
+	s.updates.Broadcast()
+	return nil
 }
 
-func (s *Store) deleteItem(itemID int64) bool {
+func (s *Store) deleteItem(ctx context.Context, itemID int64) (bool, error) {
 	s.Lock()
 	defer s.Unlock()
 
 	_, ok := s.m[itemID]
 	if !ok {
-		return false
+		return false, nil
 	}
 	delete(s.m, itemID)
 
-	select {
-	case s.updateCh <- true:
-	default:
+	err := s.backend.Delete(ctx, itemID)
+	if err != nil {
+		return false, err
 	}
 
-	return true
+	s.updates.Broadcast()
+	return true, nil
 }
 
-func (s *Store) randomiseAllItems() {
+// randomiseAllItems is the demo ticker that cosmetically jitters Progress.
+// It does not bump ResourceVersion: RV is reserved for real edits
+// (addItem/deleteItem/GuaranteedUpdate) that GuaranteedUpdate's
+// optimistic-concurrency check guards against. If every tick also bumped
+// RV, a client's updateItem would race the 1.25s ticker and 409 against
+// its own stale-but-harmless baseline almost every time, rather than only
+// when a genuinely conflicting edit landed.
+func (s *Store) randomiseAllItems(ctx context.Context) error {
 	s.Lock()
 	defer s.Unlock()
 
 	for _, sg := range s.m {
-		sg = sg
-
 		newProgress := rand.Float64()
 		sg.Progress = newProgress
 		sg.Status = fmt.Sprintf("%.2f %%", newProgress*100)
 		s.m[sg.ID] = sg
-	}
 
-	select {
-	case s.updateCh <- true:
-	default:
+		err := s.backend.Put(ctx, sg)
+		if err != nil {
+			return err
+		}
 	}
+
+	s.updates.Broadcast()
+	return nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import "sync"
+
+// notifier is a best-effort fan-out signal: every subscriber gets its own
+// buffered channel, so a single Broadcast wakes all of them, rather than
+// (as a single shared channel would) only one. /request long polls and
+// /events SSE streams each subscribe independently.
+type notifier struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{subs: make(map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value each time Broadcast is
+// called. Callers must Unsubscribe when done listening.
+func (n *notifier) Subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.subs[ch] = struct{}{}
+	n.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stops ch from receiving further signals.
+func (n *notifier) Unsubscribe(ch chan struct{}) {
+	n.mu.Lock()
+	delete(n.subs, ch)
+	n.mu.Unlock()
+}
+
+// Broadcast wakes every current subscriber. Subscribers that are already
+// pending a signal (their buffered channel is full) are left alone - they
+// will re-check state and see the fresher one anyway.
+func (n *notifier) Broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrReplay is returned by replayCache.Check when additionalData has
+// already been seen within the current window.
+var ErrReplay = errors.New("replay detected")
+
+// ErrStale is returned by replayCache.Check when additionalData's
+// timestamp falls outside [now-window, now+skew].
+var ErrStale = errors.New("additional data timestamp outside replay window")
+
+type replayEntry struct {
+	ts   int64
+	hash [32]byte
+}
+
+// replayCache is a bounded sliding-window cache of recently seen
+// additional-data hashes. It replaces a single watermark timestamp (which
+// drops a fresh request that loses a race, and still accepts a replay of
+// the most recent message before the watermark advances) with: accept any
+// additional data whose timestamp is within [now-window, now+skew] and
+// whose hash has not already been seen.
+type replayCache struct {
+	mu       sync.Mutex
+	window   time.Duration
+	skew     time.Duration
+	capacity int
+	entries  []replayEntry
+}
+
+// newReplayCache creates a replayCache. window bounds how far in the past
+// a timestamp may be, skew bounds how far in the future it may be (to
+// tolerate clock drift), and capacity bounds the number of hashes retained
+// for replay detection.
+func newReplayCache(window, skew time.Duration, capacity int) *replayCache {
+	return &replayCache{
+		window:   window,
+		skew:     skew,
+		capacity: capacity,
+	}
+}
+
+// Check parses additionalData as a millisecond unix timestamp (the format
+// produced by keyexchange.CurrentTimestampBytes), returns ErrStale if it
+// falls outside the window, and returns ErrReplay if its hash has already
+// been recorded. Otherwise it records the hash and returns nil.
+func (c *replayCache) Check(additionalData []byte) error {
+	ts, err := strconv.ParseInt(string(additionalData), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().UnixMilli()
+	if ts < now-c.window.Milliseconds() || ts > now+c.skew.Milliseconds() {
+		return ErrStale
+	}
+	hash := sha256.Sum256(additionalData)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prune(now)
+
+	for _, e := range c.entries {
+		if e.hash == hash {
+			return ErrReplay
+		}
+	}
+
+	if len(c.entries) >= c.capacity {
+		c.evictOldest()
+	}
+	c.entries = append(c.entries, replayEntry{ts: ts, hash: hash})
+	return nil
+}
+
+// prune drops entries older than the window; a timestamp that old would
+// already fail the window check above, so it can never collide again.
+func (c *replayCache) prune(now int64) {
+	cutoff := now - c.window.Milliseconds()
+	live := c.entries[:0]
+	for _, e := range c.entries {
+		if e.ts >= cutoff {
+			live = append(live, e)
+		}
+	}
+	c.entries = live
+}
+
+// evictOldest removes the single oldest (by timestamp) entry, making room
+// for a new one once the cache is at capacity.
+func (c *replayCache) evictOldest() {
+	oldest := 0
+	for i, e := range c.entries {
+		if e.ts < c.entries[oldest].ts {
+			oldest = i
+		}
+	}
+	c.entries = append(c.entries[:oldest], c.entries[oldest+1:]...)
+}
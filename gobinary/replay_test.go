@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tsBytes(t time.Time) []byte {
+	return []byte(strconv.FormatInt(t.UnixMilli(), 10))
+}
+
+func TestReplayCacheInOrder(t *testing.T) {
+	c := newReplayCache(30*time.Second, 5*time.Second, 1024)
+	now := time.Now().UTC()
+
+	if err := c.Check(tsBytes(now)); err != nil {
+		t.Fatalf("first message: got %v, want nil", err)
+	}
+	if err := c.Check(tsBytes(now.Add(1 * time.Second))); err != nil {
+		t.Fatalf("second message: got %v, want nil", err)
+	}
+	if err := c.Check(tsBytes(now.Add(2 * time.Second))); err != nil {
+		t.Fatalf("third message: got %v, want nil", err)
+	}
+}
+
+func TestReplayCacheReorderedButFresh(t *testing.T) {
+	c := newReplayCache(30*time.Second, 5*time.Second, 1024)
+	now := time.Now().UTC()
+
+	if err := c.Check(tsBytes(now.Add(2 * time.Second))); err != nil {
+		t.Fatalf("later message arriving first: got %v, want nil", err)
+	}
+	if err := c.Check(tsBytes(now)); err != nil {
+		t.Fatalf("earlier message arriving second (but still in-window): got %v, want nil", err)
+	}
+}
+
+func TestReplayCacheExactReplay(t *testing.T) {
+	c := newReplayCache(30*time.Second, 5*time.Second, 1024)
+	msg := tsBytes(time.Now().UTC())
+
+	if err := c.Check(msg); err != nil {
+		t.Fatalf("first delivery: got %v, want nil", err)
+	}
+	if err := c.Check(msg); err != ErrReplay {
+		t.Fatalf("replayed delivery: got %v, want ErrReplay", err)
+	}
+}
+
+func TestReplayCacheOutOfWindow(t *testing.T) {
+	c := newReplayCache(30*time.Second, 5*time.Second, 1024)
+	now := time.Now().UTC()
+
+	if err := c.Check(tsBytes(now.Add(-time.Minute))); err != ErrStale {
+		t.Fatalf("too old: got %v, want ErrStale", err)
+	}
+	if err := c.Check(tsBytes(now.Add(time.Minute))); err != ErrStale {
+		t.Fatalf("too far in the future: got %v, want ErrStale", err)
+	}
+}
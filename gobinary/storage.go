@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// EventType identifies the kind of change carried by an Event.
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// Event is a single change reported by a StorageBackend's Watch channel.
+// Status is only populated for EventPut; ID is always populated.
+type Event struct {
+	Type   EventType
+	Status Status
+	ID     int64
+}
+
+// StorageBackend persists Store items so they survive a restart of the
+// parent process (watched via appexit.PID), and optionally lets multiple
+// processes share the same state.
+type StorageBackend interface {
+	// Load returns every persisted item and the highest ID amongst them.
+	Load(ctx context.Context) (m map[int64]Status, maxID int64, err error)
+
+	// Put creates or overwrites the item with status.ID.
+	Put(ctx context.Context, status Status) error
+
+	// Delete removes the item with id, if any.
+	Delete(ctx context.Context, id int64) error
+
+	// Watch returns a channel of Events for writes not made through this
+	// StorageBackend instance (e.g. from another process). The channel is
+	// closed when ctx is done.
+	Watch(ctx context.Context) (<-chan Event, error)
+}
+
+// ParseStorageBackend builds the StorageBackend named by the -storage flag:
+// "memory" (or an empty string) for the default in-memory backend, or
+// "bolt://<path>" for a BoltDB-backed one.
+func ParseStorageBackend(raw string) (StorageBackend, error) {
+	if raw == "" || raw == "memory" {
+		return NewMemoryBackend(), nil
+	}
+	if path, ok := strings.CutPrefix(raw, "bolt://"); ok {
+		return NewBoltBackend(path)
+	}
+	return nil, fmt.Errorf(`unrecognised -storage value %q (want "memory" or "bolt://<path>")`, raw)
+}
+
+// MemoryBackend is the default StorageBackend: it does not persist
+// anything, matching the Store's original in-memory-only behavior.
+type MemoryBackend struct{}
+
+// NewMemoryBackend creates a MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+func (b *MemoryBackend) Load(ctx context.Context) (map[int64]Status, int64, error) {
+	return map[int64]Status{}, 0, nil
+}
+
+func (b *MemoryBackend) Put(ctx context.Context, status Status) error {
+	return nil
+}
+
+func (b *MemoryBackend) Delete(ctx context.Context, id int64) error {
+	return nil
+}
+
+func (b *MemoryBackend) Watch(ctx context.Context) (<-chan Event, error) {
+	ch := make(chan Event)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltWatchInterval is how often BoltBackend.Watch polls the database for
+// changes made by another process sharing the same file. BoltDB has no
+// native change-notification API.
+const boltWatchInterval = 500 * time.Millisecond
+
+var boltItemsBucket = []byte("items")
+
+// BoltBackend is a StorageBackend backed by a BoltDB (bbolt) file, selected
+// with e.g. "-storage=bolt:///path/to/state.db".
+type BoltBackend struct {
+	db *bolt.DB
+
+	// ownMu guards ownPuts/ownDeletes, which record writes made through
+	// this BoltBackend instance so Watch can recognise and skip them -
+	// it only reports writes made by another process sharing this file.
+	ownMu      sync.Mutex
+	ownPuts    map[int64]Status
+	ownDeletes map[int64]struct{}
+}
+
+// NewBoltBackend opens (creating if needed) the BoltDB file at path.
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltItemsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{
+		db:         db,
+		ownPuts:    map[int64]Status{},
+		ownDeletes: map[int64]struct{}{},
+	}, nil
+}
+
+func (b *BoltBackend) Load(ctx context.Context) (m map[int64]Status, maxID int64, err error) {
+	m = map[int64]Status{}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltItemsBucket).ForEach(func(k, v []byte) error {
+			var status Status
+			err := json.Unmarshal(v, &status)
+			if err != nil {
+				return err
+			}
+			m[status.ID] = status
+			if status.ID > maxID {
+				maxID = status.ID
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, maxID, nil
+}
+
+func (b *BoltBackend) Put(ctx context.Context, status Status) error {
+	v, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltItemsBucket).Put(boltKey(status.ID), v)
+	})
+	if err != nil {
+		return err
+	}
+	b.ownMu.Lock()
+	b.ownPuts[status.ID] = status
+	b.ownMu.Unlock()
+	return nil
+}
+
+func (b *BoltBackend) Delete(ctx context.Context, id int64) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltItemsBucket).Delete(boltKey(id))
+	})
+	if err != nil {
+		return err
+	}
+	b.ownMu.Lock()
+	b.ownDeletes[id] = struct{}{}
+	b.ownMu.Unlock()
+	return nil
+}
+
+// Watch polls the database every boltWatchInterval and diffs it against the
+// last-seen snapshot, so writes made by another process sharing this file
+// reach s.m via Store.watchBackend. Writes made through Put/Delete on this
+// same BoltBackend instance are recognised against ownPuts/ownDeletes and
+// skipped, since Store already applied them directly - matching the
+// StorageBackend.Watch contract.
+func (b *BoltBackend) Watch(ctx context.Context) (<-chan Event, error) {
+	last, _, err := b.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Event, 16)
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(boltWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, _, err := b.Load(ctx)
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			b.ownMu.Lock()
+			for id, status := range current {
+				// Error is always nil in this codebase, so comparing
+				// Status by value here is safe.
+				prev, ok := last[id]
+				if ok && prev == status {
+					continue
+				}
+				if own, ok := b.ownPuts[id]; ok && own == status {
+					delete(b.ownPuts, id)
+					continue
+				}
+				ch <- Event{Type: EventPut, Status: status, ID: id}
+			}
+			for id := range last {
+				if _, ok := current[id]; ok {
+					continue
+				}
+				if _, ok := b.ownDeletes[id]; ok {
+					delete(b.ownDeletes, id)
+					continue
+				}
+				ch <- Event{Type: EventDelete, ID: id}
+			}
+			b.ownMu.Unlock()
+			last = current
+		}
+	}()
+	return ch, nil
+}
+
+func boltKey(id int64) []byte {
+	return []byte(strconv.FormatInt(id, 10))
+}